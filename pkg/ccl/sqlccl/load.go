@@ -0,0 +1,343 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package sqlccl
+
+import (
+	"bufio"
+	"context"
+	gosql "database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// defaultLoadBatchBytes and defaultLoadParallelism are used when the
+// corresponding LoadOptions fields are left at their zero value.
+const (
+	defaultLoadBatchBytes  = 16 << 20 // 16MB
+	defaultLoadParallelism = 4
+)
+
+// LoadOptions configures how Load batches and parallelizes the statements it
+// reads from its input.
+type LoadOptions struct {
+	// BatchBytes bounds how many bytes of statements Load accumulates before
+	// handing a batch off to a worker. Zero selects defaultLoadBatchBytes.
+	BatchBytes int64
+	// Parallelism bounds how many batches Load executes concurrently. Zero
+	// selects defaultLoadParallelism.
+	Parallelism int
+}
+
+// LoadResult summarizes a completed Load.
+type LoadResult struct {
+	// DataSize is the number of bytes written to the backup produced at dir.
+	DataSize int64
+}
+
+// loadBatch is a group of statements, handed off once it reaches BatchBytes
+// (so the statement that crosses BatchBytes is part of the batch), and the
+// number of bytes those statements occupy in their ';'-terminated form.
+type loadBatch struct {
+	stmts []string
+	bytes int64
+}
+
+// createTableNameRe extracts the table name a dump's CREATE TABLE statement
+// is about to create, so Load can make way for it and clean up after it
+// without disturbing any other object in dbName.
+var createTableNameRe = regexp.MustCompile(`(?is)^CREATE TABLE\s+(?:IF NOT EXISTS\s+)?([A-Za-z0-9_."]+)`)
+
+// schemaStmt is a single schema statement read by runLoadSegment when it
+// reaches the next segment's boundary, carried over to the following call to
+// execLeadingSchemaStatements so that statement doesn't have to be read off
+// br twice. The zero value means "nothing pending -- read the next statement
+// from br".
+type schemaStmt struct {
+	text  string
+	atEOF bool
+}
+
+// Load reads a sequence of ';'-terminated SQL statements (as produced by a
+// tool like pg_dump) from r, executes them against dbName in BatchBytes-sized
+// batches spread across Parallelism concurrent workers, and backs up the
+// result to dir. dbName itself is never dropped and is otherwise left as the
+// caller found it: any table the dump creates is dropped (if necessary) to
+// make way for it before loading, and dropped again once the backup
+// completes, so dbName is ready for the backup at dir to be restored into it.
+// Statements are parsed and grouped into batches as they're read off r, so a
+// multi-GB dump never needs to be materialized in memory all at once.
+//
+// A dump may interleave any number of tables, the way pg_dump emits one
+// CREATE TABLE followed by that table's INSERTs before moving on to the
+// next table: Load processes the statements between one schema statement and
+// the next as a segment, running that segment's CREATE TABLE serially before
+// handing its INSERTs to the worker pool, and draining the pool before
+// moving on to the next segment's schema statement. Batches within a segment
+// still run concurrently and in no particular order, but a table is never
+// used by a batch -- in this segment or a later one -- before its own CREATE
+// TABLE has committed.
+func Load(
+	ctx context.Context,
+	sqlDB *gosql.DB,
+	r io.Reader,
+	dbName string,
+	dir string,
+	opts LoadOptions,
+) (LoadResult, error) {
+	batchBytes := opts.BatchBytes
+	if batchBytes <= 0 {
+		batchBytes = defaultLoadBatchBytes
+	}
+	parallelism := opts.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultLoadParallelism
+	}
+
+	if _, err := sqlDB.ExecContext(ctx, fmt.Sprintf(`CREATE DATABASE IF NOT EXISTS %s`, dbName)); err != nil {
+		return LoadResult{}, errors.Wrap(err, "creating database")
+	}
+
+	br := bufio.NewReaderSize(r, 1<<16)
+
+	var createdTables []string
+	var pending schemaStmt
+	for {
+		// The dump's leading schema statements for this segment (e.g. its
+		// CREATE TABLE) must run serially, and complete, before any of this
+		// segment's INSERT batches are allowed onto the worker pool below:
+		// the workers make no ordering guarantee between batches, and this
+		// era of CockroachDB can't use a table in the same transaction that
+		// created it.
+		firstDataStmt, _, segTables, err := execLeadingSchemaStatements(ctx, sqlDB, dbName, br, pending)
+		if err != nil {
+			return LoadResult{}, err
+		}
+		createdTables = append(createdTables, segTables...)
+		if firstDataStmt == "" {
+			// br is exhausted: execLeadingSchemaStatements only returns an
+			// empty firstDataStmt once it's hit EOF without finding another
+			// INSERT.
+			break
+		}
+
+		next, atEOF, err := runLoadSegment(ctx, sqlDB, dbName, br, firstDataStmt, batchBytes, parallelism)
+		if err != nil {
+			return LoadResult{}, err
+		}
+		if atEOF {
+			break
+		}
+		pending = next
+	}
+
+	var unused string
+	var dataSize int64
+	if err := sqlDB.QueryRowContext(
+		ctx, fmt.Sprintf(`BACKUP DATABASE %s TO '%s'`, dbName, dir),
+	).Scan(&unused, &unused, &unused, &dataSize); err != nil {
+		return LoadResult{}, errors.Wrap(err, "backing up loaded database")
+	}
+
+	for _, table := range createdTables {
+		if err := execLoadBatch(
+			ctx, sqlDB, dbName, []string{fmt.Sprintf(`DROP TABLE IF EXISTS %s`, table)},
+		); err != nil {
+			return LoadResult{}, errors.Wrapf(err, "dropping loaded table %s", table)
+		}
+	}
+
+	return LoadResult{DataSize: dataSize}, nil
+}
+
+// execLeadingSchemaStatements executes, one at a time and serially, the
+// schema statements (e.g. CREATE TABLE) that lead a segment, stopping as
+// soon as it reaches that segment's first INSERT statement. If pending is
+// non-zero, it's processed as the first statement of the segment instead of
+// reading one off br -- this is how the caller hands back the statement
+// runLoadSegment read to detect the previous segment's boundary. Before
+// running a CREATE TABLE, it drops any existing table of the same name so a
+// dbName the caller has already seeded (e.g. with an empty placeholder
+// table) doesn't collide with the dump's own schema. It returns the first
+// INSERT statement encountered, ready to seed the caller's first batch;
+// whether br was exhausted before any INSERT was found; and the names of the
+// tables it created, so the caller can clean them up once the backup they
+// feed is complete.
+func execLeadingSchemaStatements(
+	ctx context.Context, sqlDB *gosql.DB, dbName string, br *bufio.Reader, pending schemaStmt,
+) (firstDataStmt string, atEOF bool, createdTables []string, _ error) {
+	havePending := pending.text != ""
+	for {
+		var stmt string
+		var stmtAtEOF bool
+		if havePending {
+			stmt, stmtAtEOF = pending.text, pending.atEOF
+			havePending = false
+		} else {
+			s, err := br.ReadString(';')
+			if err != nil && err != io.EOF {
+				return "", false, nil, errors.Wrap(err, "reading statements")
+			}
+			stmt, stmtAtEOF = s, err == io.EOF
+		}
+		trimmed := strings.TrimSpace(strings.TrimSuffix(stmt, ";"))
+		if trimmed == "" {
+			if stmtAtEOF {
+				return "", true, createdTables, nil
+			}
+			continue
+		}
+		if isInsertStatement(trimmed) {
+			return stmt, false, createdTables, nil
+		}
+		if m := createTableNameRe.FindStringSubmatch(trimmed); m != nil {
+			table := m[1]
+			if execErr := execLoadBatch(ctx, sqlDB, dbName, []string{fmt.Sprintf(`DROP TABLE IF EXISTS %s`, table)}); execErr != nil {
+				return "", false, nil, execErr
+			}
+			createdTables = append(createdTables, table)
+		}
+		if execErr := execLoadBatch(ctx, sqlDB, dbName, []string{stmt}); execErr != nil {
+			return "", false, nil, execErr
+		}
+		if stmtAtEOF {
+			return "", true, createdTables, nil
+		}
+	}
+}
+
+// runLoadSegment reads statements from br, starting with firstDataStmt,
+// grouping them into BatchBytes-sized batches that run concurrently across
+// parallelism workers, until it reaches either the end of the dump or the
+// next segment's leading schema statement -- a table must never be used by a
+// batch before its own CREATE TABLE has committed, and the pool gives no
+// ordering guarantee between batches, so that next schema statement can't
+// simply be queued alongside this segment's INSERTs. It returns that
+// statement, if any, for the caller to hand to execLeadingSchemaStatements
+// rather than re-reading it from br, along with whether br was exhausted.
+func runLoadSegment(
+	ctx context.Context,
+	sqlDB *gosql.DB,
+	dbName string,
+	br *bufio.Reader,
+	firstDataStmt string,
+	batchBytes int64,
+	parallelism int,
+) (next schemaStmt, atEOF bool, _ error) {
+	// batches is a bounded ring of pending statement batches: the reader
+	// below blocks once it's produced more batches than the workers have
+	// had a chance to drain, rather than reading all of this segment
+	// upfront.
+	batches := make(chan loadBatch, parallelism)
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	wg.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := execLoadBatch(ctx, sqlDB, dbName, batch.stmts); err != nil {
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+			}
+		}()
+	}
+
+	readErr := func() error {
+		defer close(batches)
+		cur := loadBatch{stmts: []string{firstDataStmt}, bytes: int64(len(firstDataStmt))}
+		for {
+			stmt, err := br.ReadString(';')
+			if err != nil && err != io.EOF {
+				return errors.Wrap(err, "reading statements")
+			}
+			trimmed := strings.TrimSpace(strings.TrimSuffix(stmt, ";"))
+			if trimmed == "" {
+				if err == io.EOF {
+					if len(cur.stmts) > 0 {
+						batches <- cur
+					}
+					atEOF = true
+					return nil
+				}
+				continue
+			}
+			if !isInsertStatement(trimmed) {
+				// The next segment's leading schema statement ends this
+				// one: flush what we have and hand the statement back to
+				// the caller to run serially, after this segment's batches
+				// have drained.
+				if len(cur.stmts) > 0 {
+					batches <- cur
+				}
+				next = schemaStmt{text: stmt, atEOF: err == io.EOF}
+				return nil
+			}
+			cur.stmts = append(cur.stmts, stmt)
+			cur.bytes += int64(len(stmt))
+			if err == io.EOF {
+				if len(cur.stmts) > 0 {
+					batches <- cur
+				}
+				atEOF = true
+				return nil
+			}
+			if cur.bytes >= batchBytes {
+				batches <- cur
+				cur = loadBatch{}
+			}
+		}
+	}()
+	wg.Wait()
+
+	if readErr != nil {
+		return schemaStmt{}, false, readErr
+	}
+	if firstErr != nil {
+		return schemaStmt{}, false, firstErr
+	}
+	return next, atEOF, nil
+}
+
+// isInsertStatement reports whether stmt, trimmed of surrounding whitespace
+// and its trailing ';', is an INSERT rather than a schema statement like
+// CREATE TABLE.
+func isInsertStatement(stmt string) bool {
+	return strings.HasPrefix(strings.ToUpper(stmt), "INSERT")
+}
+
+// execLoadBatch runs stmts against dbName inside a single transaction.
+func execLoadBatch(ctx context.Context, sqlDB *gosql.DB, dbName string, stmts []string) error {
+	txn, err := sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := txn.ExecContext(ctx, fmt.Sprintf(`SET DATABASE = %s`, dbName)); err != nil {
+		_ = txn.Rollback()
+		return err
+	}
+	for _, stmt := range stmts {
+		stmt = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(stmt), ";"))
+		if stmt == "" {
+			continue
+		}
+		if _, err := txn.ExecContext(ctx, stmt); err != nil {
+			_ = txn.Rollback()
+			return err
+		}
+	}
+	return txn.Commit()
+}
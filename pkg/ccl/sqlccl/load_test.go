@@ -0,0 +1,170 @@
+// Copyright 2016 The Cockroach Authors.
+//
+// Licensed as a CockroachDB Enterprise file under the Cockroach Community
+// License (the "License"); you may not use this file except in compliance with
+// the License. You may obtain a copy of the License at
+//
+//     https://github.com/cockroachdb/cockroach/blob/master/LICENSE
+
+package sqlccl
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/util/tracing"
+)
+
+// TestLoad drives Load with a small dump under a tiny BatchBytes and a few
+// Parallelism workers, so the single dump is necessarily split across
+// several concurrently-executed batches, and checks that it still lands
+// exactly the rows the dump describes -- in particular that a pre-existing
+// same-named table is cleanly replaced rather than collided with or
+// appended to, and that dbName itself survives for the backup at dir to be
+// restored into.
+func TestLoad(t *testing.T) {
+	defer tracing.Disable()()
+
+	const dbName = "loadtest"
+	const numAccounts = 50
+	const staleBalance = -1
+
+	ctx, dir, _, sqlDB, cleanup := backupRestoreTestSetup(t, multiNode, 0)
+	defer cleanup()
+
+	// Seed dbName with a same-named bank table holding a row Load has no
+	// business knowing about, so we can check that Load replaces it instead
+	// of colliding with it or leaving it behind.
+	sqlDB.Exec(fmt.Sprintf(`CREATE DATABASE IF NOT EXISTS %s`, dbName))
+	sqlDB.Exec(fmt.Sprintf(`CREATE TABLE %s.bank (id INT PRIMARY KEY, balance INT)`, dbName))
+	sqlDB.Exec(fmt.Sprintf(`INSERT INTO %s.bank VALUES (0, %d)`, dbName, staleBalance))
+
+	loadDir := filepath.Join(dir, "load")
+	result, err := Load(ctx, sqlDB.DB, newBankStatementGenerator(dbName, numAccounts), dbName, loadDir, LoadOptions{
+		BatchBytes:  1,
+		Parallelism: 4,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if result.DataSize <= 0 {
+		t.Fatalf("expected a non-zero backup size, got %d", result.DataSize)
+	}
+
+	// dbName must survive: this only succeeds if it's still there for Load's
+	// caller to restore into.
+	sqlDB.Exec(fmt.Sprintf(`CREATE TABLE %s.sentinel (id INT PRIMARY KEY)`, dbName))
+
+	sqlDB.Exec(fmt.Sprintf(`RESTORE %s.* FROM '%s'`, dbName, loadDir))
+
+	var rowCount int
+	sqlDB.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s.bank`, dbName)).Scan(&rowCount)
+	if rowCount != numAccounts {
+		t.Fatalf("expected %d accounts after restore, got %d", numAccounts, rowCount)
+	}
+
+	var staleCount int
+	sqlDB.QueryRow(
+		fmt.Sprintf(`SELECT count(*) FROM %s.bank WHERE balance = $1`, dbName), staleBalance,
+	).Scan(&staleCount)
+	if staleCount != 0 {
+		t.Fatalf("expected the pre-existing row to be replaced by Load, found %d", staleCount)
+	}
+}
+
+// TestLoadUnqualifiedCreateTable drives Load with a dump whose CREATE TABLE
+// names its table the way a real pg_dump does -- unqualified, not
+// dbName-qualified the way bankStatementGenerator's always are -- to check
+// that Load's post-backup cleanup drops the table it created from dbName
+// specifically, rather than from whatever database the pooled connection
+// that happens to run the DROP TABLE defaults to.
+func TestLoadUnqualifiedCreateTable(t *testing.T) {
+	defer tracing.Disable()()
+
+	const dbName = "loadtest_unqualified"
+
+	ctx, dir, _, sqlDB, cleanup := backupRestoreTestSetup(t, multiNode, 0)
+	defer cleanup()
+
+	dump := strings.NewReader(
+		"CREATE TABLE bank (id INT PRIMARY KEY, balance INT);\n" +
+			"INSERT INTO bank (id, balance) VALUES (0, 0);\n" +
+			"INSERT INTO bank (id, balance) VALUES (1, 1);\n",
+	)
+
+	loadDir := filepath.Join(dir, "load")
+	if _, err := Load(ctx, sqlDB.DB, dump, dbName, loadDir, LoadOptions{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// If Load's cleanup dropped "bank" from the wrong database, dbName.bank
+	// would still be sitting around here and this DROP TABLE would succeed.
+	if _, err := sqlDB.DB.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s.bank`, dbName)); err == nil {
+		t.Fatalf("expected Load to have already dropped %s.bank once its backup completed", dbName)
+	}
+
+	sqlDB.Exec(fmt.Sprintf(`RESTORE %s.* FROM '%s'`, dbName, loadDir))
+
+	var rowCount int
+	sqlDB.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s.bank`, dbName)).Scan(&rowCount)
+	if rowCount != 2 {
+		t.Fatalf("expected 2 accounts after restore, got %d", rowCount)
+	}
+}
+
+// TestLoadMultiTable drives Load with a dump that interleaves two tables --
+// CREATE TABLE a, a's INSERTs, CREATE TABLE b, b's INSERTs -- the shape a
+// real pg_dump emits one table at a time, to confirm every table is
+// created, used, and cleaned up in order, not just the first one Load
+// encounters.
+func TestLoadMultiTable(t *testing.T) {
+	defer tracing.Disable()()
+
+	const dbName = "loadtest_multitable"
+
+	ctx, dir, _, sqlDB, cleanup := backupRestoreTestSetup(t, multiNode, 0)
+	defer cleanup()
+
+	dump := strings.NewReader(
+		"CREATE TABLE a (id INT PRIMARY KEY, v INT);\n" +
+			"INSERT INTO a (id, v) VALUES (0, 0);\n" +
+			"INSERT INTO a (id, v) VALUES (1, 1);\n" +
+			"INSERT INTO a (id, v) VALUES (2, 2);\n" +
+			"CREATE TABLE b (id INT PRIMARY KEY, v INT);\n" +
+			"INSERT INTO b (id, v) VALUES (0, 10);\n" +
+			"INSERT INTO b (id, v) VALUES (1, 11);\n",
+	)
+
+	loadDir := filepath.Join(dir, "load")
+	// A tiny BatchBytes spreads each table's INSERTs across several
+	// concurrently-executed batches, so this also exercises that a's batches
+	// fully drain before b's CREATE TABLE runs.
+	if _, err := Load(ctx, sqlDB.DB, dump, dbName, loadDir, LoadOptions{
+		BatchBytes:  1,
+		Parallelism: 4,
+	}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	// Both tables' CREATE TABLE must have been cleaned up from dbName, not
+	// just the first one Load's leading-schema pass used to handle.
+	for _, table := range []string{"a", "b"} {
+		if _, err := sqlDB.DB.ExecContext(ctx, fmt.Sprintf(`DROP TABLE %s.%s`, dbName, table)); err == nil {
+			t.Fatalf("expected Load to have already dropped %s.%s once its backup completed", dbName, table)
+		}
+	}
+
+	sqlDB.Exec(fmt.Sprintf(`RESTORE %s.* FROM '%s'`, dbName, loadDir))
+
+	var aCount, bCount int
+	sqlDB.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s.a`, dbName)).Scan(&aCount)
+	sqlDB.QueryRow(fmt.Sprintf(`SELECT count(*) FROM %s.b`, dbName)).Scan(&bCount)
+	if aCount != 3 {
+		t.Fatalf("expected 3 rows in a, got %d", aCount)
+	}
+	if bCount != 2 {
+		t.Fatalf("expected 2 rows in b, got %d", bCount)
+	}
+}